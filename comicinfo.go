@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// ComicInfo is the subset of the ComicRack ComicInfo.xml schema this
+// tool populates. It doubles as the shape for both sidecar formats
+// (comicinfo.json, comicinfo.xml) so a sidecar can be unmarshalled
+// straight into it.
+type ComicInfo struct {
+	XMLName xml.Name `xml:"ComicInfo" json:"-"`
+	Xsi     string   `xml:"xmlns:xsi,attr" json:"-"`
+	Xsd     string   `xml:"xmlns:xsd,attr" json:"-"`
+
+	Series    string `xml:"Series,omitempty" json:"series,omitempty"`
+	Number    string `xml:"Number,omitempty" json:"number,omitempty"`
+	Title     string `xml:"Title,omitempty" json:"title,omitempty"`
+	Volume    int    `xml:"Volume,omitempty" json:"volume,omitempty"`
+	Writer    string `xml:"Writer,omitempty" json:"writer,omitempty"`
+	Penciller string `xml:"Penciller,omitempty" json:"penciller,omitempty"`
+	Publisher string `xml:"Publisher,omitempty" json:"publisher,omitempty"`
+	Year      int    `xml:"Year,omitempty" json:"year,omitempty"`
+	Month     int    `xml:"Month,omitempty" json:"month,omitempty"`
+	PageCount int    `xml:"PageCount,omitempty" json:"pageCount,omitempty"`
+
+	Pages *ComicPages `xml:"Pages" json:"-"`
+}
+
+// ComicPages wraps the per-page entries, matching the nested <Pages>
+// element ComicRack expects.
+type ComicPages struct {
+	Page []ComicPage `xml:"Page"`
+}
+
+// ComicPage describes a single page within the archive.
+type ComicPage struct {
+	Image       int    `xml:"Image,attr"`
+	ImageSize   int64  `xml:"ImageSize,attr"`
+	ImageWidth  int    `xml:"ImageWidth,attr,omitempty"`
+	ImageHeight int    `xml:"ImageHeight,attr,omitempty"`
+	Type        string `xml:"Type,attr,omitempty"`
+}
+
+// buildComicInfo assembles the ComicInfo.xml contents for one folder.
+// Fields are layered from lowest to highest priority: CLI flags first,
+// then the folder-name regex match, then a comicinfo.json/comicinfo.xml
+// sidecar in the source folder, so the most specific source wins.
+func buildComicInfo(sourceDir, folderName string, imageFiles []ImageFile, opts *Options) *ComicInfo {
+	info := &ComicInfo{
+		Xsi:       "http://www.w3.org/2001/XMLSchema-instance",
+		Xsd:       "http://www.w3.org/2001/XMLSchema",
+		Series:    opts.Series,
+		Writer:    opts.Writer,
+		Penciller: opts.Penciller,
+		Publisher: opts.Publisher,
+		Year:      opts.Year,
+		PageCount: len(imageFiles),
+	}
+
+	if opts.FolderPattern != nil {
+		applyFolderNameMatch(info, opts.FolderPattern, folderName)
+	}
+
+	sidecar, err := loadComicInfoSidecar(sourceDir)
+	if err != nil {
+		logWarning(fmt.Sprintf("Could not read ComicInfo sidecar in %s: %v", folderName, err))
+	} else if sidecar != nil {
+		mergeComicInfo(info, sidecar)
+	}
+
+	info.Pages = buildComicPages(imageFiles)
+	return info
+}
+
+// applyFolderNameMatch fills in ComicInfo fields from named capture
+// groups (Series, Volume, Number, Title) in the folder-name pattern.
+func applyFolderNameMatch(info *ComicInfo, re *regexp.Regexp, folderName string) {
+	match := re.FindStringSubmatch(folderName)
+	if match == nil {
+		return
+	}
+
+	for i, name := range re.SubexpNames() {
+		if i == 0 || name == "" || match[i] == "" {
+			continue
+		}
+		switch name {
+		case "Series":
+			info.Series = match[i]
+		case "Number":
+			info.Number = match[i]
+		case "Title":
+			info.Title = match[i]
+		case "Volume":
+			if v, err := strconv.Atoi(match[i]); err == nil {
+				info.Volume = v
+			}
+		}
+	}
+}
+
+// loadComicInfoSidecar looks for a comicinfo.json or comicinfo.xml file
+// in the source folder, in that order, and returns its parsed contents.
+// It returns (nil, nil) when neither sidecar is present.
+func loadComicInfoSidecar(dir string) (*ComicInfo, error) {
+	jsonPath := filepath.Join(dir, "comicinfo.json")
+	if data, err := os.ReadFile(jsonPath); err == nil {
+		var info ComicInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", jsonPath, err)
+		}
+		return &info, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	xmlPath := filepath.Join(dir, "comicinfo.xml")
+	if data, err := os.ReadFile(xmlPath); err == nil {
+		var info ComicInfo
+		if err := xml.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", xmlPath, err)
+		}
+		return &info, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// mergeComicInfo overwrites dst's fields with any non-zero values from
+// src, leaving fields src didn't set untouched.
+func mergeComicInfo(dst, src *ComicInfo) {
+	if src.Series != "" {
+		dst.Series = src.Series
+	}
+	if src.Number != "" {
+		dst.Number = src.Number
+	}
+	if src.Title != "" {
+		dst.Title = src.Title
+	}
+	if src.Volume != 0 {
+		dst.Volume = src.Volume
+	}
+	if src.Writer != "" {
+		dst.Writer = src.Writer
+	}
+	if src.Penciller != "" {
+		dst.Penciller = src.Penciller
+	}
+	if src.Publisher != "" {
+		dst.Publisher = src.Publisher
+	}
+	if src.Year != 0 {
+		dst.Year = src.Year
+	}
+	if src.Month != 0 {
+		dst.Month = src.Month
+	}
+}
+
+// buildComicPages turns the scanned image list into <Page> entries,
+// marking page 0 as the front cover as ComicRack expects.
+func buildComicPages(imageFiles []ImageFile) *ComicPages {
+	pages := make([]ComicPage, len(imageFiles))
+	for i, img := range imageFiles {
+		page := ComicPage{Image: i, ImageWidth: img.Width, ImageHeight: img.Height}
+		if fi, err := os.Stat(img.Path); err == nil {
+			page.ImageSize = fi.Size()
+		}
+		if i == 0 {
+			page.Type = "FrontCover"
+		}
+		pages[i] = page
+	}
+	return &ComicPages{Page: pages}
+}
+
+// writeComicInfoEntry marshals info and writes it as the ComicInfo.xml
+// entry of the archive.
+func writeComicInfoEntry(zipWriter *zip.Writer, info *ComicInfo) error {
+	data, err := xml.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	writer, err := zipWriter.Create("ComicInfo.xml")
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
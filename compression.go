@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionMode selects how addFileToZip compresses each entry.
+type CompressionMode int
+
+const (
+	// CompressionAuto picks Store for already-compressed image formats
+	// (JPEG/PNG/WebP/AVIF/HEIF) and Deflate for everything else, keyed
+	// off the MIME type recorded by analyzeDirectory.
+	CompressionAuto CompressionMode = iota
+	CompressionStore
+	CompressionDeflate
+	CompressionZstd
+)
+
+// zstdMethod is the ZIP "method 93" identifier used by 7-Zip and other
+// tools for Zstandard entries. Readers that don't recognize it will
+// refuse to extract these entries, so -compression=zstd trades broad
+// compatibility for a better ratio/speed tradeoff than Deflate.
+const zstdMethod = 0x5d
+
+func init() {
+	zip.RegisterCompressor(zstdMethod, func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	})
+	zip.RegisterDecompressor(zstdMethod, func(r io.Reader) io.ReadCloser {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return io.NopCloser(&errReader{err: err})
+		}
+		return zr.IOReadCloser()
+	})
+}
+
+// errReader always returns the wrapped error, used to surface a failed
+// zstd.NewReader through the io.ReadCloser the zip package expects.
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// precompressedMimeTypes are image formats that already carry their own
+// entropy coding; deflating them again costs CPU for ~0% savings.
+var precompressedMimeTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+	"image/avif": true,
+	"image/heif": true,
+	"image/heic": true,
+}
+
+// isobmffBrands maps ISOBMFF major/compatible brands to the image MIME
+// type they represent. http.DetectContentType doesn't recognize AVIF or
+// HEIF/HEIC - both are built on the same "ftyp box" container format as
+// MP4 - so their brand has to be sniffed directly or they get silently
+// classified as non-images and dropped from the archive.
+var isobmffBrands = map[string]string{
+	"avif": "image/avif",
+	"avis": "image/avif",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"hevc": "image/heic",
+	"hevx": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+}
+
+// isobmffExtensions is a last-resort fallback keyed on file extension,
+// used only when the header is too short to contain a full ftyp box.
+var isobmffExtensions = map[string]string{
+	".avif": "image/avif",
+	".heic": "image/heic",
+	".heif": "image/heif",
+}
+
+// detectImageMimeType classifies a file from its header bytes, falling
+// back to ISOBMFF ftyp-box brand sniffing, TIFF/PSD magic bytes, and
+// finally file extension, for formats http.DetectContentType does not
+// recognize on its own (a real AVIF/HEIC ftyp box, a TIFF byte-order
+// marker, and a PSD signature all sniff as application/octet-stream).
+func detectImageMimeType(header []byte, filePath string) string {
+	mimeType := http.DetectContentType(header)
+	if strings.HasPrefix(mimeType, "image/") {
+		return mimeType
+	}
+
+	if brand, ok := sniffISOBMFFBrand(header); ok {
+		return brand
+	}
+
+	if mt, ok := sniffTIFFOrPSD(header); ok {
+		return mt
+	}
+
+	if brand, ok := isobmffExtensions[strings.ToLower(filepath.Ext(filePath))]; ok {
+		return brand
+	}
+
+	return mimeType
+}
+
+// sniffISOBMFFBrand reads the major brand out of an ISOBMFF "ftyp" box.
+func sniffISOBMFFBrand(header []byte) (string, bool) {
+	if len(header) < 12 || string(header[4:8]) != "ftyp" {
+		return "", false
+	}
+	brand, ok := isobmffBrands[string(header[8:12])]
+	return brand, ok
+}
+
+// sniffTIFFOrPSD checks for TIFF's byte-order marker ("II*\0" little-
+// endian or "MM\0*" big-endian) and PSD's "8BPS" signature, neither of
+// which http.DetectContentType recognizes.
+func sniffTIFFOrPSD(header []byte) (string, bool) {
+	if len(header) < 4 {
+		return "", false
+	}
+	switch {
+	case header[0] == 'I' && header[1] == 'I' && header[2] == '*' && header[3] == 0:
+		return "image/tiff", true
+	case header[0] == 'M' && header[1] == 'M' && header[2] == 0 && header[3] == '*':
+		return "image/tiff", true
+	case string(header[0:4]) == "8BPS":
+		return "image/vnd.adobe.photoshop", true
+	}
+	return "", false
+}
+
+// parseCompressionMode validates the -compression flag value.
+func parseCompressionMode(value string) (CompressionMode, error) {
+	switch strings.ToLower(value) {
+	case "", "auto":
+		return CompressionAuto, nil
+	case "store":
+		return CompressionStore, nil
+	case "deflate":
+		return CompressionDeflate, nil
+	case "zstd":
+		return CompressionZstd, nil
+	default:
+		return CompressionAuto, fmt.Errorf("unknown compression mode %q (want auto, store, deflate, or zstd)", value)
+	}
+}
+
+// selectCompressionMethod resolves the configured CompressionMode to a
+// concrete zip method for a single file, consulting its MIME type only
+// when mode is CompressionAuto.
+func selectCompressionMethod(mode CompressionMode, mimeType string) uint16 {
+	switch mode {
+	case CompressionStore:
+		return zip.Store
+	case CompressionDeflate:
+		return zip.Deflate
+	case CompressionZstd:
+		return zstdMethod
+	default:
+		if precompressedMimeTypes[mimeType] {
+			return zip.Store
+		}
+		return zip.Deflate
+	}
+}
@@ -2,17 +2,24 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
 	"flag"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
-	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	_ "golang.org/x/image/webp"
 )
 
 // ANSI color codes for professional logging
@@ -40,14 +47,55 @@ type WorkItem struct {
 	FolderName string
 	SourcePath string
 	OutputPath string
+
+	// Shallow, when true, scans only SourcePath's direct files and
+	// ignores its subdirectories. Used in chapters mode for a volume
+	// folder that has both loose files and its own chapter subfolders,
+	// so those subfolders' work items don't double-count its pages.
+	Shallow bool
+}
+
+// Options bundles the run-wide settings that every stage of the
+// conversion pipeline needs access to, so adding a new flag doesn't mean
+// threading another positional parameter through every function.
+type Options struct {
+	Threads     int
+	Compression CompressionMode
+
+	// ComicInfo metadata, used only when ComicInfo is true.
+	ComicInfo     bool
+	Series        string
+	Writer        string
+	Penciller     string
+	Publisher     string
+	Year          int
+	FolderPattern *regexp.Regexp
+
+	Sort SortMode
+
+	Force  bool
+	Verify bool
 }
 
 func main() {
 	// Command line argument parsing
 	var (
-		inputDir    = flag.String("input", "", "Input directory containing folders to convert (required)")
-		outputDir   = flag.String("output", "", "Output directory for CBZ files (required)")
-		threads     = flag.Int("threads", 4, "Number of concurrent threads")
+		inputDir        = flag.String("input", "", "Input directory containing folders to convert (required)")
+		outputDir       = flag.String("output", "", "Output directory for CBZ files (required)")
+		threads         = flag.Int("threads", 4, "Number of concurrent threads")
+		compressionFlag = flag.String("compression", "auto", "Compression method: auto, store, deflate, or zstd")
+		comicInfoFlag   = flag.Bool("comicinfo", false, "Generate a ComicInfo.xml metadata entry in each CBZ")
+		seriesFlag      = flag.String("series", "", "Series name for ComicInfo.xml (overridden by sidecar/folder-name match)")
+		writerFlag      = flag.String("writer", "", "Writer credit for ComicInfo.xml")
+		pencillerFlag   = flag.String("penciller", "", "Penciller credit for ComicInfo.xml")
+		publisherFlag   = flag.String("publisher", "", "Publisher for ComicInfo.xml")
+		yearFlag        = flag.Int("year", 0, "Publication year for ComicInfo.xml")
+		folderPattern   = flag.String("folder-pattern", `^(?P<Series>.+?) v(?P<Volume>\d+) #(?P<Number>\d+)`,
+			"Regex with named groups (Series, Volume, Number, Title) used to infer ComicInfo.xml fields from the folder name")
+		sortFlag    = flag.String("sort", "natural", "Page ordering: natural, lexical, or mtime")
+		modeFlag    = flag.String("mode", "folders", "Conversion mode: folders, chapters, or single")
+		forceFlag   = flag.Bool("force", false, "Reconvert even if the source manifest matches the existing CBZ")
+		verifyFlag  = flag.Bool("verify", false, "Only check manifests against the source folders; don't write anything")
 		showHelp    = flag.Bool("help", false, "Show usage information")
 		showVersion = flag.Bool("version", false, "Show version information")
 	)
@@ -76,6 +124,34 @@ func main() {
 		logInfo(fmt.Sprintf("Thread count limited to %d (2x CPU cores)", *threads))
 	}
 
+	// Validate and resolve the compression mode
+	compressionMode, err := parseCompressionMode(*compressionFlag)
+	if err != nil {
+		logError(err.Error())
+		os.Exit(1)
+	}
+
+	// Compile the folder-name inference pattern used for ComicInfo.xml
+	folderRe, err := regexp.Compile(*folderPattern)
+	if err != nil {
+		logError(fmt.Sprintf("Invalid -folder-pattern: %v", err))
+		os.Exit(1)
+	}
+
+	// Validate and resolve the page ordering mode
+	sortMode, err := parseSortMode(*sortFlag)
+	if err != nil {
+		logError(err.Error())
+		os.Exit(1)
+	}
+
+	// Validate and resolve the conversion mode
+	mode, err := parseMode(*modeFlag)
+	if err != nil {
+		logError(err.Error())
+		os.Exit(1)
+	}
+
 	// Validate input directory exists
 	if _, err := os.Stat(*inputDir); os.IsNotExist(err) {
 		logError(fmt.Sprintf("Input directory does not exist: %s", *inputDir))
@@ -91,34 +167,43 @@ func main() {
 	logInfo(fmt.Sprintf("Starting CBZ conversion with %d threads", *threads))
 	logInfo(fmt.Sprintf("Input:  %s", *inputDir))
 	logInfo(fmt.Sprintf("Output: %s", *outputDir))
+	logInfo(fmt.Sprintf("Mode:   %s", mode))
 
-	// Get list of folders to process
-	folders, err := getFolders(*inputDir)
+	// Build the list of work items according to the conversion mode:
+	// one CBZ per direct child folder, one per leaf chapter folder found
+	// anywhere in the tree, or the whole input folder as a single comic.
+	workItems, err := buildWorkItems(*inputDir, *outputDir, mode)
 	if err != nil {
 		logError(fmt.Sprintf("Failed to read input directory: %v", err))
 		os.Exit(1)
 	}
 
-	if len(folders) == 0 {
+	if len(workItems) == 0 {
 		logWarning("No folders found in input directory")
 		return
 	}
 
-	logInfo(fmt.Sprintf("Found %d folders to process", len(folders)))
-
-	// Create work items
-	workItems := make([]WorkItem, len(folders))
-	for i, folder := range folders {
-		workItems[i] = WorkItem{
-			FolderName: folder,
-			SourcePath: filepath.Join(*inputDir, folder),
-			OutputPath: filepath.Join(*outputDir, folder+".cbz"),
-		}
-	}
-
-	// Process folders concurrently
-	stats := &ConversionStats{Total: len(folders)}
-	processConcurrently(workItems, *threads, stats)
+	logInfo(fmt.Sprintf("Found %d items to process", len(workItems)))
+
+	// Process folders concurrently. The same thread count also bounds the
+	// per-file worker pool used to compress very large images in parallel,
+	// so one oversized scan doesn't leave the rest of the pool idle.
+	opts := &Options{
+		Threads:       *threads,
+		Compression:   compressionMode,
+		ComicInfo:     *comicInfoFlag,
+		Series:        *seriesFlag,
+		Writer:        *writerFlag,
+		Penciller:     *pencillerFlag,
+		Publisher:     *publisherFlag,
+		Year:          *yearFlag,
+		FolderPattern: folderRe,
+		Sort:          sortMode,
+		Force:         *forceFlag,
+		Verify:        *verifyFlag,
+	}
+	stats := &ConversionStats{Total: len(workItems)}
+	processConcurrently(workItems, opts, stats)
 
 	// Print final statistics
 	printFinalStats(stats)
@@ -136,6 +221,18 @@ func showUsage() {
 	fmt.Println()
 	fmt.Println("OPTIONS:")
 	fmt.Println("  -threads int       Number of concurrent threads (default: 4)")
+	fmt.Println("  -compression string  Compression method: auto, store, deflate, zstd (default: auto)")
+	fmt.Println("  -comicinfo         Generate a ComicInfo.xml metadata entry in each CBZ")
+	fmt.Println("  -series string     Series name for ComicInfo.xml")
+	fmt.Println("  -writer string     Writer credit for ComicInfo.xml")
+	fmt.Println("  -penciller string  Penciller credit for ComicInfo.xml")
+	fmt.Println("  -publisher string  Publisher for ComicInfo.xml")
+	fmt.Println("  -year int          Publication year for ComicInfo.xml")
+	fmt.Println("  -folder-pattern string  Regex to infer ComicInfo.xml fields from folder names")
+	fmt.Println("  -sort string       Page ordering: natural, lexical, mtime (default: natural)")
+	fmt.Println("  -mode string       Conversion mode: folders, chapters, single (default: folders)")
+	fmt.Println("  -force             Reconvert even if the source manifest matches the existing CBZ")
+	fmt.Println("  -verify            Only check manifests against the source folders; don't write anything")
 	fmt.Println("  -help             Show this help message")
 	fmt.Println("  -version          Show version information")
 	fmt.Println()
@@ -147,7 +244,7 @@ func showUsage() {
 	fmt.Println("  1. Scan each folder in the input directory")
 	fmt.Println("  2. Detect image files using MIME type analysis")
 	fmt.Println("  3. Create compressed CBZ files in the output directory")
-	fmt.Println("  4. Skip existing CBZ files to avoid overwriting")
+	fmt.Println("  4. Skip folders whose source files are unchanged since the last run")
 	fmt.Println("  5. Report non-image files found but not included")
 }
 
@@ -170,17 +267,17 @@ func getFolders(dir string) ([]string, error) {
 	return folders, nil
 }
 
-func processConcurrently(workItems []WorkItem, numThreads int, stats *ConversionStats) {
+func processConcurrently(workItems []WorkItem, opts *Options, stats *ConversionStats) {
 	// Create work channel with buffer to prevent blocking
-	workChan := make(chan WorkItem, numThreads)
+	workChan := make(chan WorkItem, opts.Threads)
 
 	// Create wait group to track completion
 	var wg sync.WaitGroup
 
 	// Start worker goroutines
-	for i := range numThreads {
+	for i := range opts.Threads {
 		wg.Add(1)
-		go worker(i+1, workChan, &wg, stats)
+		go worker(i+1, workChan, &wg, stats, opts)
 	}
 
 	// Send work items to channel
@@ -195,35 +292,59 @@ func processConcurrently(workItems []WorkItem, numThreads int, stats *Conversion
 	wg.Wait()
 }
 
-func worker(id int, workChan <-chan WorkItem, wg *sync.WaitGroup, stats *ConversionStats) {
+func worker(id int, workChan <-chan WorkItem, wg *sync.WaitGroup, stats *ConversionStats, opts *Options) {
 	defer wg.Done()
 
 	for item := range workChan {
 		// Process single conversion job
-		processWorkItem(id, item, stats)
+		processWorkItem(id, item, stats, opts)
 
 		// Small delay to prevent overwhelming the system
 		time.Sleep(5 * time.Millisecond)
 	}
 }
 
-func processWorkItem(workerID int, item WorkItem, stats *ConversionStats) {
+func processWorkItem(workerID int, item WorkItem, stats *ConversionStats, opts *Options) {
 	prefix := fmt.Sprintf("[WORKER %d]", workerID)
 
 	logInfo(fmt.Sprintf("%s Processing: %s", prefix, truncateString(item.FolderName, 60)))
 
-	// Check if output already exists
-	if _, err := os.Stat(item.OutputPath); err == nil {
-		logWarning(fmt.Sprintf("%s CBZ already exists, skipping: %s", prefix, filepath.Base(item.OutputPath)))
+	// Hash the source folder so re-runs can tell whether pages were added
+	// or changed, rather than just checking whether the CBZ exists.
+	currentManifest, err := computeManifest(item.SourcePath, item.Shallow)
+	if err != nil {
+		logError(fmt.Sprintf("%s Failed to hash source folder: %v", prefix, err))
 		stats.mu.Lock()
-		stats.Skipped++
+		stats.Errors++
 		stats.mu.Unlock()
 		return
 	}
+	manifestPath := manifestFilePath(item.OutputPath)
 
-	// Convert folder to CBZ
-	nonImageCount, err := convertToCBZ(item.SourcePath, item.OutputPath)
+	if opts.Verify {
+		verifyManifest(prefix, item, currentManifest, manifestPath, stats)
+		return
+	}
+
+	if !opts.Force {
+		if existing, err := loadManifest(manifestPath); err == nil && existing != nil && manifestsEqual(existing, currentManifest) {
+			if _, statErr := os.Stat(item.OutputPath); statErr == nil {
+				logWarning(fmt.Sprintf("%s Source unchanged, skipping: %s", prefix, filepath.Base(item.OutputPath)))
+				stats.mu.Lock()
+				stats.Skipped++
+				stats.mu.Unlock()
+				return
+			}
+		}
+	}
+
+	// Rebuild into a temp file and atomically rename over the existing
+	// CBZ, so a crash mid-conversion never leaves a half-written archive
+	// in place of a good one.
+	tempPath := item.OutputPath + ".tmp"
+	nonImageCount, err := convertToCBZ(item.SourcePath, tempPath, item.FolderName, opts, item.Shallow)
 	if err != nil {
+		os.Remove(tempPath)
 		logError(fmt.Sprintf("%s Conversion failed: %v", prefix, err))
 		stats.mu.Lock()
 		stats.Errors++
@@ -231,6 +352,18 @@ func processWorkItem(workerID int, item WorkItem, stats *ConversionStats) {
 		return
 	}
 
+	if err := os.Rename(tempPath, item.OutputPath); err != nil {
+		logError(fmt.Sprintf("%s Failed to finalize CBZ: %v", prefix, err))
+		stats.mu.Lock()
+		stats.Errors++
+		stats.mu.Unlock()
+		return
+	}
+
+	if err := writeManifest(manifestPath, currentManifest); err != nil {
+		logWarning(fmt.Sprintf("%s Failed to write manifest: %v", prefix, err))
+	}
+
 	// Update statistics
 	stats.mu.Lock()
 	stats.Success++
@@ -245,9 +378,9 @@ func processWorkItem(workerID int, item WorkItem, stats *ConversionStats) {
 	}
 }
 
-func convertToCBZ(sourceDir, cbzPath string) (int, error) {
+func convertToCBZ(sourceDir, cbzPath, folderName string, opts *Options, shallow bool) (int, error) {
 	// Scan directory for image and non-image files
-	imageFiles, nonImageFiles, err := analyzeDirectory(sourceDir)
+	imageFiles, nonImageFiles, err := analyzeDirectory(sourceDir, opts.Sort, shallow)
 	if err != nil {
 		return 0, fmt.Errorf("failed to analyze directory: %w", err)
 	}
@@ -267,9 +400,18 @@ func convertToCBZ(sourceDir, cbzPath string) (int, error) {
 	zipWriter := zip.NewWriter(cbzFile)
 	defer zipWriter.Close()
 
+	// Optionally emit a ComicInfo.xml metadata entry for ComicRack-family
+	// readers (Komga, Kavita, Mylar) before the page images.
+	if opts.ComicInfo {
+		info := buildComicInfo(sourceDir, folderName, imageFiles, opts)
+		if err := writeComicInfoEntry(zipWriter, info); err != nil {
+			return 0, fmt.Errorf("failed to write ComicInfo.xml: %w", err)
+		}
+	}
+
 	// Add all image files to the ZIP archive
-	for _, imagePath := range imageFiles {
-		if err := addFileToZip(zipWriter, imagePath, sourceDir); err != nil {
+	for _, img := range imageFiles {
+		if err := addFileToZip(zipWriter, img, sourceDir, opts); err != nil {
 			return 0, fmt.Errorf("failed to add file to archive: %w", err)
 		}
 	}
@@ -277,78 +419,133 @@ func convertToCBZ(sourceDir, cbzPath string) (int, error) {
 	return len(nonImageFiles), nil
 }
 
-func analyzeDirectory(dir string) ([]string, []string, error) {
-	var imageFiles []string
-	var nonImageFiles []string
-
-	// Walk through directory tree recursively
-	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
+// ImageFile is an image found by analyzeDirectory, carrying everything
+// downstream stages need (compression selection, ComicInfo.xml page
+// entries) so they don't have to re-read the file a second time.
+type ImageFile struct {
+	Path     string
+	MimeType string
+	Width    int
+	Height   int
+	ModTime  time.Time
+}
 
-		// Skip directories, only process files
-		if d.IsDir() {
-			return nil
-		}
+// analyzeDirectory scans dir for image and non-image files. With shallow
+// set it only looks at dir's direct entries, ignoring subdirectories
+// entirely; this is used for a chapters-mode volume folder that has its
+// own loose files (e.g. a cover) alongside chapter subfolders, so those
+// subfolders' own work items don't have their pages counted twice.
+func analyzeDirectory(dir string, sortMode SortMode, shallow bool) ([]ImageFile, []string, error) {
+	var imageFiles []ImageFile
+	var nonImageFiles []string
 
-		// Determine if file is an image using MIME type detection
-		isImage, err := isImageFile(path)
+	classify := func(path string, modTime time.Time) {
+		// Determine the file's MIME type and, for images, its pixel
+		// dimensions, from its header bytes
+		mimeType, width, height, err := analyzeImageFile(path)
 		if err != nil {
-			// If MIME detection fails, include file anyway (fail-safe approach)
+			// If detection fails, include file anyway (fail-safe approach)
 			// This prevents losing files due to permission issues or corrupted headers
 			logWarning(fmt.Sprintf("Could not determine file type for %s, including in archive", filepath.Base(path)))
-			imageFiles = append(imageFiles, path)
-		} else if isImage {
-			imageFiles = append(imageFiles, path)
+			imageFiles = append(imageFiles, ImageFile{Path: path, ModTime: modTime})
+		} else if strings.HasPrefix(mimeType, "image/") {
+			imageFiles = append(imageFiles, ImageFile{Path: path, MimeType: mimeType, Width: width, Height: height, ModTime: modTime})
 		} else {
 			// Track non-image files for reporting purposes
 			nonImageFiles = append(nonImageFiles, filepath.Base(path))
 		}
+	}
 
-		return nil
-	})
-
-	if err != nil {
-		return nil, nil, err
+	if shallow {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			var modTime time.Time
+			if info, infoErr := entry.Info(); infoErr == nil {
+				modTime = info.ModTime()
+			}
+			classify(filepath.Join(dir, entry.Name()), modTime)
+		}
+	} else {
+		err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			// Skip directories, only process files
+			if d.IsDir() {
+				return nil
+			}
+
+			var modTime time.Time
+			if info, infoErr := d.Info(); infoErr == nil {
+				modTime = info.ModTime()
+			}
+
+			classify(path, modTime)
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	// Sort files for consistent ordering in the archive
-	// This ensures pages appear in the correct sequence
-	sort.Strings(imageFiles)
+	// Order pages according to the requested sort mode. This determines
+	// the order pages appear in the archive, so getting it wrong is a
+	// fatal bug for a comic rather than a cosmetic one.
+	sortImageFiles(imageFiles, sortMode)
 	sort.Strings(nonImageFiles)
 
 	return imageFiles, nonImageFiles, nil
 }
 
-func isImageFile(filePath string) (bool, error) {
+// analyzeImageFile sniffs a file's MIME type from its header bytes using
+// Go's built-in content detection, and for recognized image formats also
+// decodes just the image header to recover its pixel dimensions. Doing
+// both from the same read means ComicInfo.xml page sizes come for free
+// during the initial directory walk instead of a second pass later.
+func analyzeImageFile(filePath string) (mimeType string, width, height int, err error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return false, err
+		return "", 0, 0, err
 	}
 	defer file.Close()
 
 	// Read first 512 bytes for MIME type detection
 	// This is sufficient for http.DetectContentType to identify most formats
-	buffer := make([]byte, 512)
-	_, err = file.Read(buffer)
+	header := make([]byte, 512)
+	n, err := file.Read(header)
 	if err != nil && err != io.EOF {
-		return false, err
+		return "", 0, 0, err
 	}
+	header = header[:n]
 
-	// Use Go's built-in MIME type detection
-	// This checks file headers/magic bytes rather than relying on extensions
-	mimeType := http.DetectContentType(buffer)
+	mimeType = detectImageMimeType(header, filePath)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return mimeType, 0, 0, nil
+	}
 
-	// Any MIME type starting with "image/" is considered an image
-	// This includes JPEG, PNG, GIF, WebP, HEIF, AVIF, etc.
-	return strings.HasPrefix(mimeType, "image/"), nil
+	// Decode just the header: prepend the bytes already read back onto
+	// the stream so image.DecodeConfig doesn't need a seek.
+	cfg, _, cfgErr := image.DecodeConfig(io.MultiReader(bytes.NewReader(header), file))
+	if cfgErr != nil {
+		// Dimensions are a nice-to-have for ComicInfo.xml, not essential
+		// to including the file in the archive.
+		return mimeType, 0, 0, nil
+	}
+
+	return mimeType, cfg.Width, cfg.Height, nil
 }
 
-func addFileToZip(zipWriter *zip.Writer, filePath, baseDir string) error {
+func addFileToZip(zipWriter *zip.Writer, img ImageFile, baseDir string, opts *Options) error {
 	// Calculate relative path for the ZIP entry
 	// This preserves the directory structure within the archive
-	relPath, err := filepath.Rel(baseDir, filePath)
+	relPath, err := filepath.Rel(baseDir, img.Path)
 	if err != nil {
 		return err
 	}
@@ -357,7 +554,7 @@ func addFileToZip(zipWriter *zip.Writer, filePath, baseDir string) error {
 	relPath = filepath.ToSlash(relPath)
 
 	// Open source file
-	sourceFile, err := os.Open(filePath)
+	sourceFile, err := os.Open(img.Path)
 	if err != nil {
 		return err
 	}
@@ -369,6 +566,21 @@ func addFileToZip(zipWriter *zip.Writer, filePath, baseDir string) error {
 		return err
 	}
 
+	method := selectCompressionMethod(opts.Compression, img.MimeType)
+
+	// Large scans (oversized PNG/TIFF pages) get split across a worker
+	// pool instead of going through a single flate.Writer, so one big
+	// file doesn't leave the rest of -threads idle. This only applies
+	// when the resolved method is Deflate; Store and Zstd write straight
+	// through.
+	if method == zip.Deflate && fileInfo.Size() > parallelCompressThreshold {
+		content, err := io.ReadAll(sourceFile)
+		if err != nil {
+			return err
+		}
+		return addFileToZipParallel(zipWriter, relPath, fileInfo, content, opts.Threads)
+	}
+
 	// Create ZIP file header
 	header, err := zip.FileInfoHeader(fileInfo)
 	if err != nil {
@@ -377,7 +589,7 @@ func addFileToZip(zipWriter *zip.Writer, filePath, baseDir string) error {
 
 	// Set compression method and file path
 	header.Name = relPath
-	header.Method = zip.Deflate // Use compression to reduce file size
+	header.Method = method
 
 	// Create ZIP entry
 	writer, err := zipWriter.CreateHeader(header)
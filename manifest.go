@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ManifestEntry records one source file's identity at conversion time.
+type ManifestEntry struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // Unix seconds
+	SHA256  string `json:"sha256"`
+}
+
+// ConversionManifest is the sidecar written next to each CBZ, letting a
+// re-run detect whether the source folder changed instead of just
+// checking whether the output file exists.
+type ConversionManifest struct {
+	Files []ManifestEntry `json:"files"`
+}
+
+// manifestFilePath is the sidecar path for a given CBZ output path.
+func manifestFilePath(cbzPath string) string {
+	return cbzPath + ".manifest.json"
+}
+
+// computeManifest hashes every file in sourceDir (not just images, so an
+// added ComicInfo.json sidecar also triggers a rebuild). When shallow is
+// true it only hashes sourceDir's direct files, matching the CBZ that
+// convertToCBZ produces for a shallow WorkItem - otherwise an unrelated
+// change in a sibling chapter subfolder would make the manifest mismatch
+// and force a pointless reconversion.
+func computeManifest(sourceDir string, shallow bool) (*ConversionManifest, error) {
+	var entries []ManifestEntry
+
+	add := func(path string, info os.FileInfo) error {
+		sum, err := sha256File(path)
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, ManifestEntry{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime().Unix(),
+			SHA256:  sum,
+		})
+		return nil
+	}
+
+	if shallow {
+		dirEntries, err := os.ReadDir(sourceDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range dirEntries {
+			if entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			if err := add(filepath.Join(sourceDir, entry.Name()), info); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		err := filepath.WalkDir(sourceDir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return add(path, info)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return &ConversionManifest{Files: entries}, nil
+}
+
+// sha256File hashes a single file's contents.
+func sha256File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadManifest reads a manifest sidecar, returning (nil, nil) when it
+// doesn't exist.
+func loadManifest(path string) (*ConversionManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var manifest ConversionManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &manifest, nil
+}
+
+// writeManifest persists a manifest sidecar after a successful conversion.
+func writeManifest(path string, manifest *ConversionManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// manifestsEqual reports whether two manifests describe the same set of
+// source files.
+func manifestsEqual(a, b *ConversionManifest) bool {
+	if len(a.Files) != len(b.Files) {
+		return false
+	}
+	for i := range a.Files {
+		if a.Files[i] != b.Files[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyManifest implements -verify: it reports whether the stored
+// manifest still matches the source folder without converting anything.
+func verifyManifest(prefix string, item WorkItem, current *ConversionManifest, manifestPath string, stats *ConversionStats) {
+	existing, err := loadManifest(manifestPath)
+	if err != nil {
+		logError(fmt.Sprintf("%s Failed to read manifest: %v", prefix, err))
+		stats.mu.Lock()
+		stats.Errors++
+		stats.mu.Unlock()
+		return
+	}
+
+	if existing == nil {
+		logWarning(fmt.Sprintf("%s No manifest found, never converted: %s", prefix, item.FolderName))
+		stats.mu.Lock()
+		stats.Errors++
+		stats.mu.Unlock()
+		return
+	}
+
+	if manifestsEqual(existing, current) {
+		logOK(fmt.Sprintf("%s Manifest matches source: %s", prefix, item.FolderName))
+		stats.mu.Lock()
+		stats.Success++
+		stats.mu.Unlock()
+		return
+	}
+
+	logWarning(fmt.Sprintf("%s Source changed since last conversion: %s", prefix, item.FolderName))
+	stats.mu.Lock()
+	stats.Errors++
+	stats.mu.Unlock()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Mode selects how the input directory maps to output CBZ files.
+type Mode int
+
+const (
+	// ModeFolders converts each direct child folder of -input into its
+	// own CBZ. This is the original, default behavior.
+	ModeFolders Mode = iota
+	// ModeChapters walks the whole input tree and produces one CBZ per
+	// folder that has files of its own - leaf chapter folders, and
+	// non-leaf volume folders that mix loose front-matter images with
+	// chapter subfolders - naming the output after the folder's path
+	// from -input so nested scanlation dumps like "Series/Vol 01/Ch 001"
+	// don't need pre-flattening.
+	ModeChapters
+	// ModeSingle treats -input itself as one comic and produces a single
+	// CBZ, with each immediate subfolder kept as a path prefix inside
+	// the archive (handled by analyzeDirectory's existing recursive
+	// walk; no special-casing needed beyond the single work item).
+	ModeSingle
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeChapters:
+		return "chapters"
+	case ModeSingle:
+		return "single"
+	default:
+		return "folders"
+	}
+}
+
+// parseMode validates the -mode flag value.
+func parseMode(value string) (Mode, error) {
+	switch strings.ToLower(value) {
+	case "", "folders":
+		return ModeFolders, nil
+	case "chapters":
+		return ModeChapters, nil
+	case "single":
+		return ModeSingle, nil
+	default:
+		return ModeFolders, fmt.Errorf("unknown mode %q (want folders, chapters, or single)", value)
+	}
+}
+
+// buildWorkItems lays out the conversion jobs for the given mode.
+func buildWorkItems(inputDir, outputDir string, mode Mode) ([]WorkItem, error) {
+	switch mode {
+	case ModeSingle:
+		name := filepath.Base(filepath.Clean(inputDir))
+		return []WorkItem{{
+			FolderName: name,
+			SourcePath: inputDir,
+			OutputPath: filepath.Join(outputDir, name+".cbz"),
+		}}, nil
+
+	case ModeChapters:
+		folders, err := discoverChapterFolders(inputDir)
+		if err != nil {
+			return nil, err
+		}
+
+		workItems := make([]WorkItem, len(folders))
+		for i, cf := range folders {
+			name, err := chapterOutputName(inputDir, cf.Path)
+			if err != nil {
+				return nil, err
+			}
+			workItems[i] = WorkItem{
+				FolderName: filepath.Base(cf.Path),
+				SourcePath: cf.Path,
+				OutputPath: filepath.Join(outputDir, name),
+				Shallow:    cf.Shallow,
+			}
+		}
+		return workItems, nil
+
+	default:
+		folders, err := getFolders(inputDir)
+		if err != nil {
+			return nil, err
+		}
+
+		workItems := make([]WorkItem, len(folders))
+		for i, folder := range folders {
+			workItems[i] = WorkItem{
+				FolderName: folder,
+				SourcePath: filepath.Join(inputDir, folder),
+				OutputPath: filepath.Join(outputDir, folder+".cbz"),
+			}
+		}
+		return workItems, nil
+	}
+}
+
+// chapterFolder is a directory discoverChapterFolders decided needs its
+// own work item.
+type chapterFolder struct {
+	Path string
+	// Shallow is true when Path also has subdirectories of its own (e.g.
+	// a volume folder with a loose cover next to a "Ch 001" subfolder),
+	// so its work item must scan only its direct files and leave the
+	// subfolders to their own work items instead of double-counting them.
+	Shallow bool
+}
+
+// discoverChapterFolders walks root and returns every directory that has
+// files of its own: true leaf chapters, and non-leaf "volume" folders -
+// including root itself - that mix loose front-matter images with
+// chapter subfolders. Sorted for a stable run order. Whether a folder's
+// own files actually include any images is left to convertToCBZ, which
+// already reports "no image files found" for an empty one.
+func discoverChapterFolders(root string) ([]chapterFolder, error) {
+	var folders []chapterFolder
+
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		hasSubdir := false
+		hasFile := false
+		for _, entry := range entries {
+			if entry.IsDir() {
+				hasSubdir = true
+			} else {
+				hasFile = true
+			}
+		}
+
+		if hasFile {
+			folders = append(folders, chapterFolder{Path: path, Shallow: hasSubdir})
+		}
+
+		if !hasSubdir {
+			// Nothing further to descend into.
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Path < folders[j].Path })
+	return folders, nil
+}
+
+// chapterOutputName turns a leaf folder's path relative to root into a
+// flat output filename, e.g. "Series/Vol 01/Ch 001" becomes
+// "Series - Vol 01 - Ch 001.cbz". leafPath == root itself (the root's own
+// loose files, discovered alongside its chapter subfolders) names the
+// output after root's own base name instead of ".".
+func chapterOutputName(root, leafPath string) (string, error) {
+	if leafPath == root {
+		return filepath.Base(filepath.Clean(root)) + ".cbz", nil
+	}
+
+	rel, err := filepath.Rel(root, leafPath)
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	return strings.Join(parts, " - ") + ".cbz", nil
+}
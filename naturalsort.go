@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SortMode selects how analyzeDirectory orders pages within an archive.
+type SortMode int
+
+const (
+	// SortNatural splits filenames into alternating text/numeric runs so
+	// "page10.jpg" sorts after "page2.jpg" instead of before it.
+	SortNatural SortMode = iota
+	// SortLexical is a plain byte-wise path comparison.
+	SortLexical
+	// SortMtime orders pages by file modification time.
+	SortMtime
+)
+
+// parseSortMode validates the -sort flag value.
+func parseSortMode(value string) (SortMode, error) {
+	switch strings.ToLower(value) {
+	case "", "natural":
+		return SortNatural, nil
+	case "lexical":
+		return SortLexical, nil
+	case "mtime":
+		return SortMtime, nil
+	default:
+		return SortNatural, fmt.Errorf("unknown sort mode %q (want natural, lexical, or mtime)", value)
+	}
+}
+
+// sortImageFiles orders images in place according to mode. Ties always
+// fall back to a lexical path comparison so the result is deterministic.
+func sortImageFiles(imageFiles []ImageFile, mode SortMode) {
+	switch mode {
+	case SortLexical:
+		sort.Slice(imageFiles, func(i, j int) bool {
+			return imageFiles[i].Path < imageFiles[j].Path
+		})
+	case SortMtime:
+		sort.Slice(imageFiles, func(i, j int) bool {
+			if !imageFiles[i].ModTime.Equal(imageFiles[j].ModTime) {
+				return imageFiles[i].ModTime.Before(imageFiles[j].ModTime)
+			}
+			return imageFiles[i].Path < imageFiles[j].Path
+		})
+	default:
+		sort.Slice(imageFiles, func(i, j int) bool {
+			a, b := imageFiles[i].Path, imageFiles[j].Path
+			if naturalLess(a, b) {
+				return true
+			}
+			if naturalLess(b, a) {
+				return false
+			}
+			return a < b
+		})
+	}
+}
+
+// naturalLess compares two paths by walking them left to right, treating
+// consecutive digits as a single numeric run compared by value (so "10"
+// sorts after "2") and everything else as case-insensitive text. Because
+// it runs over the whole path - separators included - a chapter folder
+// like "Ch 2" still naturally sorts before "Ch 10" before their page
+// numbers are even considered.
+func naturalLess(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	ar, br := []rune(a), []rune(b)
+	i, j := 0, 0
+
+	for i < len(ar) && j < len(br) {
+		ca, cb := ar[i], br[j]
+
+		if isDigit(ca) && isDigit(cb) {
+			start := i
+			for i < len(ar) && isDigit(ar[i]) {
+				i++
+			}
+			startB := j
+			for j < len(br) && isDigit(br[j]) {
+				j++
+			}
+
+			na := strings.TrimLeft(string(ar[start:i]), "0")
+			nb := strings.TrimLeft(string(br[startB:j]), "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			continue
+		}
+
+		if ca != cb {
+			return ca < cb
+		}
+		i++
+		j++
+	}
+
+	return len(ar)-i < len(br)-j
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sync"
+)
+
+const (
+	// parallelCompressThreshold is the file size above which addFileToZip
+	// switches from a single streaming flate.Writer to the block-parallel
+	// path below. Below this size the overhead of splitting and stitching
+	// outweighs the benefit of extra goroutines.
+	parallelCompressThreshold = 6 * 1024 * 1024 // 6 MB
+
+	// parallelBlockSize is the target size of each independently
+	// compressed chunk.
+	parallelBlockSize = 1 * 1024 * 1024 // 1 MB
+
+	// parallelDictWindow is how many trailing bytes of the previous block
+	// are fed to the next block's flate.Writer as a preset dictionary, so
+	// the split stream compresses close to what a single flate.Writer
+	// pass over the whole file would have produced.
+	parallelDictWindow = 32 * 1024 // 32 KB
+)
+
+// compressedBlock holds one worker's output, kept in original order so
+// the raw deflate streams can be stitched back together afterwards.
+type compressedBlock struct {
+	data []byte
+	err  error
+}
+
+// addFileToZipParallel compresses content in independent ~1 MB blocks
+// across a worker pool, then stitches the raw deflate streams into a
+// single ZIP entry via CreateRaw. Each block after the first is primed
+// with a 32 KB preset dictionary taken from the end of the previous
+// block, matching what a single uninterrupted flate.Writer would have
+// produced, and only the final block terminates the deflate stream.
+func addFileToZipParallel(zipWriter *zip.Writer, relPath string, fileInfo os.FileInfo, content []byte, numWorkers int) error {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	var blockStarts []int
+	for start := 0; start < len(content); start += parallelBlockSize {
+		blockStarts = append(blockStarts, start)
+	}
+	if len(blockStarts) == 0 {
+		blockStarts = append(blockStarts, 0)
+	}
+
+	blocks := make([]compressedBlock, len(blockStarts))
+	sem := make(chan struct{}, numWorkers)
+	var wg sync.WaitGroup
+
+	for i, start := range blockStarts {
+		end := start + parallelBlockSize
+		if end > len(content) {
+			end = len(content)
+		}
+
+		var dict []byte
+		if start > 0 {
+			dictStart := start - parallelDictWindow
+			if dictStart < 0 {
+				dictStart = 0
+			}
+			dict = content[dictStart:start]
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i, start, end int, dict []byte, isLast bool) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			blocks[i].data, blocks[i].err = compressBlock(content[start:end], dict, isLast)
+		}(i, start, end, dict, i == len(blockStarts)-1)
+	}
+
+	wg.Wait()
+
+	var combined bytes.Buffer
+	for _, b := range blocks {
+		if b.err != nil {
+			return fmt.Errorf("failed to compress block: %w", b.err)
+		}
+		combined.Write(b.data)
+	}
+
+	header, err := zip.FileInfoHeader(fileInfo)
+	if err != nil {
+		return err
+	}
+	header.Name = relPath
+	header.Method = zip.Deflate
+	header.CRC32 = crc32.ChecksumIEEE(content)
+	header.UncompressedSize64 = uint64(len(content))
+	header.CompressedSize64 = uint64(combined.Len())
+
+	writer, err := zipWriter.CreateRaw(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(combined.Bytes())
+	return err
+}
+
+// compressBlock runs a single block through its own flate.Writer. Every
+// block but the last ends with Flush, a byte-aligned non-final stored
+// block, rather than Close, so the raw outputs can be concatenated into
+// one valid deflate stream; only the final block sets BFINAL via Close.
+func compressBlock(data, dict []byte, isLast bool) ([]byte, error) {
+	var buf bytes.Buffer
+
+	var fw *flate.Writer
+	var err error
+	if len(dict) > 0 {
+		fw, err = flate.NewWriterDict(&buf, flate.DefaultCompression, dict)
+	} else {
+		fw, err = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if isLast {
+		if err := fw.Close(); err != nil {
+			return nil, err
+		}
+	} else if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}